@@ -0,0 +1,214 @@
+package courier
+
+import (
+	"net"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+	"blitiri.com.ar/go/chasquid/internal/smtp"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// Exported variables.
+var (
+	connReuse = expvarom.NewInt("chasquid/smarthostOut/conn_reuse",
+		"count of smarthost deliveries that reused an existing connection")
+
+	// connPipeliningCapable counts pooled deliveries made over a connection
+	// where the peer advertised PIPELINING. This package does NOT batch
+	// the MAIL/RCPT/DATA writes to take advantage of it (that needs write
+	// access below smtp.Client's request/response abstraction, which this
+	// package doesn't have) — pipelining itself is not implemented, only
+	// detected. This metric exists so the opportunity can be measured
+	// before anyone takes on implementing the batched path.
+	connPipeliningCapable = expvarom.NewInt("chasquid/smarthostOut/pipelining_capable",
+		"count of pooled smarthost deliveries made over a connection where the peer advertised PIPELINING; writes are NOT batched, this is detection only")
+)
+
+// connIdleTimeout is how long an unused pooled connection is kept open
+// before being closed.
+var connIdleTimeout = 5 * time.Minute
+
+// connMaxMessages bounds how many messages we send over a single pooled
+// connection, to limit how long a single TLS session lives.
+const connMaxMessages = 100
+
+// poolMaxIdleConns bounds how many idle connections we keep cached per
+// smarthost for reuse; deliveries beyond that each get a fresh connection.
+const poolMaxIdleConns = 4
+
+// pooledConn is a cached, authenticated connection to a smarthost.
+type pooledConn struct {
+	conn   net.Conn
+	client *smtp.Client
+	onTLS  bool
+
+	// submission is the SubmissionMeta this connection was last set up or
+	// refreshed for (nil if none). It is recorded whether or not XCLIENT
+	// was actually sent, i.e. also when XCLIENT is disabled or not
+	// advertised. deliver refreshes it before reusing the connection for
+	// a different one.
+	submission *SubmissionMeta
+
+	// pipelining is whether the peer advertised PIPELINING support.
+	pipelining bool
+
+	msgCount int
+	lastUsed time.Time
+}
+
+func (pc *pooledConn) close() {
+	_ = pc.client.Quit()
+	pc.conn.Close()
+}
+
+// getConn returns a usable connection for e, reusing a cached one if it is
+// still healthy and within its message/idle limits, or establishing a new
+// one otherwise. This lazy check, run each time a connection is requested,
+// is the only thing that reaps stale idle connections: there's no
+// background goroutine evicting them proactively, so a smarthost that
+// stops being used entirely will keep its idle connections cached (and
+// the peer may close them first, which release's next use will notice
+// and discard).
+func (e *poolEntry) getConn(tr *trace.Trace, submission *SubmissionMeta) (*pooledConn, bool, error) {
+	e.connMu.Lock()
+	var pc *pooledConn
+	for len(e.conns) > 0 {
+		n := len(e.conns) - 1
+		pc, e.conns = e.conns[n], e.conns[:n]
+
+		stale := time.Since(pc.lastUsed) > connIdleTimeout ||
+			pc.msgCount >= connMaxMessages
+		if !stale {
+			break
+		}
+		pc.close()
+		pc = nil
+	}
+	e.connMu.Unlock()
+
+	if pc != nil {
+		connReuse.Add(1)
+		return pc, true, nil
+	}
+
+	conn, c, onTLS, err := e.sh.connect(tr, submission)
+	if err != nil {
+		return nil, false, err
+	}
+	pipelining, _ := c.Extension("PIPELINING")
+	return &pooledConn{conn: conn, client: c, onTLS: onTLS, submission: submission, pipelining: pipelining}, false, nil
+}
+
+// release puts pc back in e's pool of idle connections for reuse, or
+// closes it if it's no longer usable or the pool is already at
+// poolMaxIdleConns.
+func (e *poolEntry) release(pc *pooledConn, usable bool) {
+	if !usable {
+		pc.close()
+		return
+	}
+
+	pc.lastUsed = time.Now()
+
+	e.connMu.Lock()
+	if len(e.conns) >= poolMaxIdleConns {
+		e.connMu.Unlock()
+		pc.close()
+		return
+	}
+	e.conns = append(e.conns, pc)
+	e.connMu.Unlock()
+}
+
+// deliver sends one envelope via e, reusing a pooled connection when
+// possible.
+func (e *poolEntry) deliver(from string, to string, data []byte, opts DeliverOptions) (error, bool) {
+	tr := trace.New("Courier.SmartHostPool", to)
+	defer tr.Finish()
+
+	pc, reused, err := e.getConn(tr, opts.Submission)
+	if err != nil {
+		return err, false
+	}
+
+	// A connection fresh out of connect() is always submission-consistent
+	// (connect sent the right XCLIENT itself, if any), so only pooled
+	// connections need checking here. Each iteration either accepts pc as
+	// usable or discards it and asks getConn for another one, so a pool
+	// with several differently-tagged idle connections can't make us
+	// settle for the first inconsistent one we happen to pop; we either
+	// land on a consistent pooled connection or fall through to a fresh
+	// dial, which is consistent by construction.
+	for reused {
+		if err := pc.client.Reset(); err != nil {
+			// The cached connection is no longer usable; drop it and try
+			// the next one.
+			pc.close()
+			if pc, reused, err = e.getConn(tr, opts.Submission); err != nil {
+				return err, false
+			}
+			continue
+		}
+
+		if pc.submission != nil && opts.Submission == nil {
+			// sendXClient no-ops when there's nothing to forward, so it
+			// can't un-forward the identity this connection was last
+			// tagged with; reusing it would misattribute this
+			// (XCLIENT-less) delivery to the previous submission. Try
+			// the next pooled connection instead.
+			pc.close()
+			if pc, reused, err = e.getConn(tr, opts.Submission); err != nil {
+				return err, false
+			}
+			continue
+		}
+
+		if submissionEqual(pc.submission, opts.Submission) {
+			break
+		}
+
+		// The connection was last used (or set up) for a different
+		// submission; bring its forwarded XCLIENT identity up to date
+		// before reusing it, trying the next one if that fails.
+		if err := e.sh.sendXClient(tr, pc.client, opts.Submission); err != nil {
+			pc.close()
+			if pc, reused, err = e.getConn(tr, opts.Submission); err != nil {
+				return err, false
+			}
+			continue
+		}
+		pc.submission = opts.Submission
+		break
+	}
+
+	sendErr, permanent := e.sh.sendOne(tr, pc.client, pc.onTLS, from, to, data, opts)
+	pc.msgCount++
+
+	if sendErr != nil {
+		e.release(pc, false)
+		return sendErr, permanent
+	}
+
+	if pc.pipelining {
+		connPipeliningCapable.Add(1)
+	}
+
+	e.release(pc, true)
+	return nil, false
+}
+
+// Drain closes all pooled connections, so they don't linger across a
+// configuration reload or shutdown. In-flight deliveries are unaffected;
+// they will simply establish a new connection next time.
+func (p *SmartHostPool) Drain() {
+	for _, e := range p.entries {
+		e.connMu.Lock()
+		conns := e.conns
+		e.conns = nil
+		e.connMu.Unlock()
+		for _, pc := range conns {
+			pc.close()
+		}
+	}
+}
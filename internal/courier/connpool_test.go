@@ -0,0 +1,337 @@
+package courier
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolEntryConnReuse(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250 STARTTLS\n",
+		"STARTTLS":          "220 tls ok\n",
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"RSET":              "250 reset ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+	defer srv.wg.Wait()
+
+	e := &poolEntry{
+		sh: &SmartHost{
+			HelloDomain: "hello",
+			URL:         newSmartHost(t, srv.addr).URL,
+			rootCAs:     srv.rootCAs,
+		},
+		label: srv.addr,
+	}
+
+	err, _ := e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if err != nil {
+		t.Fatalf("first delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 {
+		t.Fatalf("expected one connection to be cached after a successful delivery, got %d", len(e.conns))
+	}
+	cached := e.conns[0]
+	e.connMu.Unlock()
+
+	before := cached.msgCount
+	err, _ = e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if err != nil {
+		t.Fatalf("second (reused) delivery failed: %v", err)
+	}
+	if cached.msgCount != before+1 {
+		t.Errorf("msgCount = %d, want %d", cached.msgCount, before+1)
+	}
+
+	e.connMu.Lock()
+	conns := e.conns
+	e.conns = nil
+	e.connMu.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+func TestPoolEntryXClientRefreshedOnReuse(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":               "220 welcome\n",
+		"EHLO hello":             "250-ehlo ok\n250-STARTTLS\n250 XCLIENT ADDR\n",
+		"STARTTLS":               "220 tls ok\n",
+		"XCLIENT ADDR=192.0.2.1": "250 ok\n",
+		"XCLIENT ADDR=192.0.2.2": "250 ok\n",
+		"MAIL FROM:<me@me>":      "250 mail ok\n",
+		"RCPT TO:<to@to>":        "250 rcpt ok\n",
+		"DATA":                   "354 send data\n",
+		"_DATA":                  "250 data ok\n",
+		"RSET":                   "250 reset ok\n",
+		"QUIT":                   "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+	defer srv.wg.Wait()
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "xclient=1"
+	sh.rootCAs = srv.rootCAs
+	e := &poolEntry{sh: sh, label: srv.addr}
+
+	opts1 := DeliverOptions{Submission: &SubmissionMeta{ClientIP: "192.0.2.1"}}
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), opts1); err != nil {
+		t.Fatalf("first delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 {
+		t.Fatalf("expected one cached connection, got %d", len(e.conns))
+	}
+	cached := e.conns[0]
+	e.connMu.Unlock()
+	if cached.submission == nil || cached.submission.ClientIP != "192.0.2.1" {
+		t.Fatalf("cached connection's submission = %+v, want ClientIP 192.0.2.1", cached.submission)
+	}
+
+	// Deliver again via the same pooled connection, but for a different
+	// submission: the peer must see an updated XCLIENT, not the original.
+	opts2 := DeliverOptions{Submission: &SubmissionMeta{ClientIP: "192.0.2.2"}}
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), opts2); err != nil {
+		t.Fatalf("second (reused) delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 || e.conns[0] != cached || cached.submission.ClientIP != "192.0.2.2" {
+		t.Errorf("expected the reused connection's submission to be refreshed to 192.0.2.2, got %+v", e.conns[0])
+	}
+	conns := e.conns
+	e.conns = nil
+	e.connMu.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+func TestPoolEntryFreshConnWhenSubmissionDrops(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":               "220 welcome\n",
+		"EHLO hello":             "250-ehlo ok\n250-STARTTLS\n250 XCLIENT ADDR\n",
+		"STARTTLS":               "220 tls ok\n",
+		"XCLIENT ADDR=192.0.2.1": "250 ok\n",
+		"MAIL FROM:<me@me>":      "250 mail ok\n",
+		"RCPT TO:<to@to>":        "250 rcpt ok\n",
+		"DATA":                   "354 send data\n",
+		"_DATA":                  "250 data ok\n",
+		"RSET":                   "250 reset ok\n",
+		"QUIT":                   "250 quit ok\n",
+	}
+	// Two connections are expected: the cached one (tagged via XCLIENT)
+	// must be dropped rather than reused for the second, submission-less
+	// delivery.
+	srv := newFakeServerConns(t, responses, 2)
+	defer srv.wg.Wait()
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "xclient=1"
+	sh.rootCAs = srv.rootCAs
+	e := &poolEntry{sh: sh, label: srv.addr}
+
+	opts1 := DeliverOptions{Submission: &SubmissionMeta{ClientIP: "192.0.2.1"}}
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), opts1); err != nil {
+		t.Fatalf("first delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	cached := e.conns[0]
+	e.connMu.Unlock()
+
+	// Deliver again on the same entry, but without submission metadata:
+	// reusing the XCLIENT-tagged connection would misattribute this
+	// delivery to the previous submission, so a fresh connection must be
+	// used instead.
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{}); err != nil {
+		t.Fatalf("second delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 || e.conns[0] == cached {
+		t.Errorf("expected the submission-less delivery to use a fresh connection, not the cached one")
+	}
+	conns := e.conns
+	e.conns = nil
+	e.connMu.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+func TestPoolEntrySkipsAllMistaggedConnsOnReuse(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":               "220 welcome\n",
+		"EHLO hello":             "250-ehlo ok\n250-STARTTLS\n250 XCLIENT ADDR\n",
+		"STARTTLS":               "220 tls ok\n",
+		"XCLIENT ADDR=192.0.2.1": "250 ok\n",
+		"XCLIENT ADDR=192.0.2.2": "250 ok\n",
+		"MAIL FROM:<me@me>":      "250 mail ok\n",
+		"RCPT TO:<to@to>":        "250 rcpt ok\n",
+		"DATA":                   "354 send data\n",
+		"_DATA":                  "250 data ok\n",
+		"RSET":                   "250 reset ok\n",
+		"QUIT":                   "250 quit ok\n",
+	}
+	// Three connections are expected: two concurrent deliveries each dial
+	// their own (since the pool starts empty), leaving both cached and
+	// differently XCLIENT-tagged; the third, submission-less delivery
+	// must reject both rather than settle for whichever it pops first,
+	// and fall through to a genuinely fresh dial.
+	srv := newFakeServerConns(t, responses, 3)
+	defer srv.wg.Wait()
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "xclient=1"
+	sh.rootCAs = srv.rootCAs
+	e := &poolEntry{sh: sh, label: srv.addr}
+
+	var wg sync.WaitGroup
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			opts := DeliverOptions{Submission: &SubmissionMeta{ClientIP: ip}}
+			if err, _ := e.deliver("me@me", "to@to", []byte("data"), opts); err != nil {
+				t.Errorf("delivery for %s failed: %v", ip, err)
+			}
+		}(ip)
+	}
+	wg.Wait()
+
+	e.connMu.Lock()
+	if len(e.conns) != 2 {
+		e.connMu.Unlock()
+		t.Fatalf("expected two cached, differently-tagged connections, got %d", len(e.conns))
+	}
+	mistagged := map[*pooledConn]bool{e.conns[0]: true, e.conns[1]: true}
+	e.connMu.Unlock()
+
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{}); err != nil {
+		t.Fatalf("third (submission-less) delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 {
+		e.connMu.Unlock()
+		t.Fatalf("expected one (fresh) cached connection, got %d", len(e.conns))
+	}
+	if mistagged[e.conns[0]] {
+		e.connMu.Unlock()
+		t.Fatalf("submission-less delivery reused a connection still tagged for a prior submission")
+	}
+	if e.conns[0].submission != nil {
+		t.Errorf("expected the fresh connection's submission to be nil, got %+v", e.conns[0].submission)
+	}
+	conns := e.conns
+	e.conns = nil
+	e.connMu.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+func TestPoolEntryTracksPipeliningCapability(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250-STARTTLS\n250 PIPELINING\n",
+		"STARTTLS":          "220 tls ok\n",
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+	defer srv.wg.Wait()
+
+	e := &poolEntry{
+		sh: &SmartHost{
+			HelloDomain: "hello",
+			URL:         newSmartHost(t, srv.addr).URL,
+			rootCAs:     srv.rootCAs,
+		},
+		label: srv.addr,
+	}
+
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{}); err != nil {
+		t.Fatalf("delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 || !e.conns[0].pipelining {
+		t.Errorf("expected the cached connection to be marked as PIPELINING-capable")
+	}
+	conns := e.conns
+	e.conns = nil
+	e.connMu.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
+
+func TestPoolEntryConnIdleExpiry(t *testing.T) {
+	// There's no background goroutine evicting idle connections; getConn's
+	// own staleness check, run lazily on the next delivery, is the only
+	// thing that reaps them. Two connections are expected: the first gets
+	// cached and left to expire, the second is dialed fresh once it has.
+	connIdleTimeout = 10 * time.Millisecond
+	defer func() { connIdleTimeout = 5 * time.Minute }()
+
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250 STARTTLS\n",
+		"STARTTLS":          "220 tls ok\n",
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServerConns(t, responses, 2)
+	defer srv.wg.Wait()
+
+	e := &poolEntry{
+		sh: &SmartHost{
+			HelloDomain: "hello",
+			URL:         newSmartHost(t, srv.addr).URL,
+			rootCAs:     srv.rootCAs,
+		},
+		label: srv.addr,
+	}
+
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{}); err != nil {
+		t.Fatalf("first delivery failed: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err, _ := e.deliver("me@me", "to@to", []byte("data"), DeliverOptions{}); err != nil {
+		t.Fatalf("second delivery failed: %v", err)
+	}
+
+	e.connMu.Lock()
+	if len(e.conns) != 1 {
+		e.connMu.Unlock()
+		t.Fatalf("expected one (fresh) cached connection, got %d", len(e.conns))
+	}
+	if e.conns[0].msgCount != 1 {
+		t.Errorf("msgCount = %d, want 1: the stale connection should have been replaced, not reused", e.conns[0].msgCount)
+	}
+	conns := e.conns
+	e.conns = nil
+	e.connMu.Unlock()
+	for _, pc := range conns {
+		pc.close()
+	}
+}
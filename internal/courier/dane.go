@@ -0,0 +1,208 @@
+package courier
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// TLSMode controls how SmartHost validates the peer's TLS certificate.
+type TLSMode int
+
+const (
+	// TLSStrict validates against the web PKI (s.rootCAs), and requires
+	// the peer to advertise STARTTLS; delivery fails rather than falling
+	// back to an unencrypted connection. It is the default, matching prior
+	// behaviour (which always failed delivery when STARTTLS wasn't
+	// advertised).
+	//
+	// Once STARTTLS is attempted, failures are always fatal, in every
+	// mode: silently falling back to the plaintext connection after a
+	// failed negotiation is indistinguishable from a STARTTLS-stripping
+	// attack, so we never do that.
+	TLSStrict TLSMode = iota
+
+	// TLSOpportunistic is like Strict, but doesn't require the peer to
+	// support STARTTLS at all: if it isn't advertised, delivery proceeds
+	// over the unencrypted connection rather than failing outright. This
+	// weakens the connection to a STARTTLS-stripping attacker, so it must
+	// be requested explicitly via "?tls=opportunistic".
+	TLSOpportunistic
+
+	// TLSDANE requires DNSSEC-authenticated TLSA records for the peer, and
+	// validates the certificate chain against them (RFC 7672) instead of
+	// the web PKI. Delivery fails if no usable TLSA records are found.
+	TLSDANE
+)
+
+func parseTLSMode(s string) TLSMode {
+	switch s {
+	case "opportunistic":
+		return TLSOpportunistic
+	case "dane":
+		return TLSDANE
+	default:
+		return TLSStrict
+	}
+}
+
+// lookupTLSAFunc looks up the TLSA records for a host and port; it's a
+// variable, rather than a direct call to lookupTLSA, so tests can inject
+// a fake resolver instead of hitting a live one.
+var lookupTLSAFunc = lookupTLSA
+
+// lookupTLSA looks up the TLSA records for the given host and port
+// (`_<port>._tcp.<host>`), requiring the answer to be DNSSEC-authenticated
+// (the AD bit set). It returns an empty, nil-error result if the name does
+// not exist or carries no TLSA records.
+func lookupTLSA(host, port string) ([]*dns.TLSA, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("could not load resolver config: %v", err)
+	}
+
+	name := fmt.Sprintf("_%s._tcp.%s", port, dns.Fqdn(host))
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTLSA)
+	m.SetEdns0(4096, true) // DO bit, so we get DNSSEC signatures/AD status.
+
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, conf.Servers[0]+":"+conf.Port)
+	if err != nil {
+		return nil, fmt.Errorf("DNS query for %s failed: %v", name, err)
+	}
+
+	if r.Rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DNS query for %s returned %s", name, dns.RcodeToString[r.Rcode])
+	}
+	if !r.AuthenticatedData {
+		return nil, fmt.Errorf("TLSA answer for %s is not DNSSEC-authenticated", name)
+	}
+
+	var recs []*dns.TLSA
+	for _, rr := range r.Answer {
+		if tlsa, ok := rr.(*dns.TLSA); ok {
+			recs = append(recs, tlsa)
+		}
+	}
+	return recs, nil
+}
+
+// verifyDANE checks whether the presented certificate chain satisfies any
+// of the given TLSA records, per RFC 7672.
+//
+// Usage 3 (DANE-EE) records pin the leaf (end-entity) certificate directly:
+// a selector match is sufficient proof, since the peer demonstrated
+// possession of the matching private key during the handshake.
+//
+// Usage 2 (DANE-TA) records pin a trust anchor, which may or may not be
+// part of the presented chain. A selector match against some certificate
+// in the chain is not enough on its own: we must also verify that the
+// leaf actually chains up to that anchor, or an unrelated cert bundled
+// into the chain by a malicious peer could be used to "match" a TLSA
+// record that has nothing to do with the leaf being presented.
+func verifyDANE(rawCerts [][]byte, tlsas []*dns.TLSA) error {
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("error parsing presented certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	leaf := certs[0]
+
+	for _, tlsa := range tlsas {
+		switch tlsa.Usage {
+		case 3: // DANE-EE
+			data, err := selectorData(leaf, tlsa.Selector)
+			if err != nil {
+				continue
+			}
+			if matches(data, tlsa.MatchingType, tlsa.Certificate) {
+				return nil
+			}
+
+		case 2: // DANE-TA
+			for _, anchor := range certs {
+				data, err := selectorData(anchor, tlsa.Selector)
+				if err != nil {
+					continue
+				}
+				if !matches(data, tlsa.MatchingType, tlsa.Certificate) {
+					continue
+				}
+				if chainsTo(leaf, certs, anchor) {
+					return nil
+				}
+			}
+
+		default:
+			// Usages 0 (PKIX-TA) and 1 (PKIX-EE) still require web-PKI
+			// validation, which we don't do in DANE mode; skip them.
+		}
+	}
+
+	return fmt.Errorf("no TLSA record matched the presented certificate chain")
+}
+
+// chainsTo reports whether leaf can be verified up to anchor, treating
+// anchor as a trusted root and the rest of the presented chain as
+// intermediates. Hostname verification is intentionally skipped: the TLSA
+// lookup already identified the peer by name.
+func chainsTo(leaf *x509.Certificate, chain []*x509.Certificate, anchor *x509.Certificate) bool {
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain {
+		if cert != leaf && cert != anchor {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+func selectorData(cert *x509.Certificate, selector uint8) ([]byte, error) {
+	switch selector {
+	case 0: // Full certificate.
+		return cert.Raw, nil
+	case 1: // SubjectPublicKeyInfo.
+		return cert.RawSubjectPublicKeyInfo, nil
+	default:
+		return nil, fmt.Errorf("unsupported TLSA selector %d", selector)
+	}
+}
+
+func matches(data []byte, matchingType uint8, want string) bool {
+	var got []byte
+	switch matchingType {
+	case 0: // Exact match.
+		got = data
+	case 1: // SHA-256.
+		sum := sha256.Sum256(data)
+		got = sum[:]
+	case 2: // SHA-512.
+		sum := sha512.Sum512(data)
+		got = sum[:]
+	default:
+		return false
+	}
+	return fmt.Sprintf("%x", got) == want
+}
@@ -21,6 +21,14 @@ type fakeServer struct {
 
 // Fake server, to test SMTP out.
 func newFakeServer(t *testing.T, responses map[string]string) *fakeServer {
+	return newFakeServerConns(t, responses, 1)
+}
+
+// newFakeServerConns is like newFakeServer, but accepts and serves up to
+// "conns" connections, each handled concurrently, for tests that need to
+// observe a pooled connection being dropped and replaced (or several
+// connections being established at once).
+func newFakeServerConns(t *testing.T, responses map[string]string, conns int) *fakeServer {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatalf("fake server listen: %v", err)
@@ -40,50 +48,62 @@ func newFakeServer(t *testing.T, responses map[string]string) *fakeServer {
 		defer srv.wg.Done()
 		defer l.Close()
 
-		var c net.Conn
-		var err error
-		c, err = l.Accept()
+		var handlers sync.WaitGroup
+		for i := 0; i < conns; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				panic(err)
+			}
+
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				serveFakeConn(t, c, responses, serverTLSConfig)
+			}()
+		}
+		handlers.Wait()
+	}()
+
+	return srv
+}
+
+// serveFakeConn speaks the canned SMTP exchange in responses over c, until
+// the client disconnects.
+func serveFakeConn(t *testing.T, c net.Conn, responses map[string]string, serverTLSConfig *tls.Config) {
+	t.Logf("fakeServer got connection")
+
+	r := textproto.NewReader(bufio.NewReader(c))
+	c.Write([]byte(responses["_welcome"]))
+	for {
+		line, err := r.ReadLine()
 		if err != nil {
-			panic(err)
+			t.Logf("fakeServer exiting: %v\n", err)
+			break
 		}
-		defer c.Close()
 
-		t.Logf("fakeServer got connection")
+		t.Logf("fakeServer read: %q\n", line)
+		c.Write([]byte(responses[line]))
 
-		r := textproto.NewReader(bufio.NewReader(c))
-		c.Write([]byte(responses["_welcome"]))
-		for {
-			line, err := r.ReadLine()
+		if line == "DATA" {
+			_, err = r.ReadDotBytes()
 			if err != nil {
 				t.Logf("fakeServer exiting: %v\n", err)
-				return
+				break
 			}
+			c.Write([]byte(responses["_DATA"]))
+		} else if line == "STARTTLS" && strings.HasPrefix(responses[line], "220 ") {
+			tlsconn := tls.Server(c, serverTLSConfig)
 
-			t.Logf("fakeServer read: %q\n", line)
-			c.Write([]byte(responses[line]))
-
-			if line == "DATA" {
-				_, err = r.ReadDotBytes()
-				if err != nil {
-					t.Logf("fakeServer exiting: %v\n", err)
-					return
-				}
-				c.Write([]byte(responses["_DATA"]))
-			} else if line == "STARTTLS" && strings.HasPrefix(responses[line], "220 ") {
-				tlsconn := tls.Server(c, serverTLSConfig)
-				defer tlsconn.Close()
-
-				if err = tlsconn.Handshake(); err != nil {
-					t.Logf("fakeServer error in STARTTLS: %v", err)
-					return
-				}
-				c = tlsconn
-				r = textproto.NewReader(bufio.NewReader(c))
+			if err = tlsconn.Handshake(); err != nil {
+				t.Logf("fakeServer error in STARTTLS: %v", err)
+				tlsconn.Close()
+				return
 			}
+			c = tlsconn
+			r = textproto.NewReader(bufio.NewReader(c))
 		}
-	}()
-
-	return srv
+	}
+	c.Close()
 }
 
 func makeResp(as ...string) map[string]string {
@@ -0,0 +1,117 @@
+package courier
+
+import "fmt"
+
+// DeliverOptions carries envelope hints computed by the queue, which
+// Courier implementations can use to negotiate ESMTP extensions with the
+// remote peer (SMTPUTF8, 8BITMIME, SIZE, REQUIRETLS).
+//
+// Implementations are free to ignore options the peer doesn't support, but
+// must honour RequireTLS: if it can't be satisfied, delivery must fail
+// rather than send over an unprotected channel.
+type DeliverOptions struct {
+	// SMTPUTF8 indicates the envelope (from/to) or headers use UTF-8, and
+	// requires the peer to support RFC 6531.
+	SMTPUTF8 bool
+
+	// EightBitMIME indicates the message body is not 7-bit clean.
+	EightBitMIME bool
+
+	// Size is the (approximate) size of the message in bytes, as per
+	// RFC 1870. 0 means unknown/unset.
+	Size int64
+
+	// RequireTLS requires the message to be relayed over a channel
+	// protected end-to-end by TLS, as per RFC 8689.
+	RequireTLS bool
+
+	// Submission carries the original submission's metadata, for
+	// forwarding to the smarthost via XCLIENT. Nil if the message didn't
+	// come in through submission, or the queue doesn't track it.
+	Submission *SubmissionMeta
+}
+
+// SubmissionMeta describes the client that originally submitted a
+// message, so that information isn't lost when relaying it onwards via a
+// smarthost that supports XCLIENT.
+type SubmissionMeta struct {
+	// ClientIP is the submitting client's IP address.
+	ClientIP string
+
+	// AuthUser is the username the client authenticated as, empty if it
+	// didn't authenticate.
+	AuthUser string
+
+	// HELO is the hostname the client gave in its own HELO/EHLO.
+	HELO string
+
+	// Proto is the protocol the client used, e.g. "ESMTPSA".
+	Proto string
+}
+
+// submissionEqual reports whether a and b describe the same submission,
+// treating two nils as equal. It's used to decide whether a pooled
+// connection's forwarded XCLIENT identity is still up to date.
+func submissionEqual(a, b *SubmissionMeta) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	return *a == *b
+}
+
+// relayLimitError marks a mailParams failure (unsatisfiable SIZE or
+// REQUIRETLS) as a property of the smarthost we just talked to, not of
+// the message or recipient. A standalone SmartHost has no other host to
+// try, so it's effectively permanent there; a SmartHostPool can instead
+// fail over to its next entry before giving up.
+type relayLimitError struct {
+	err error
+}
+
+func (e *relayLimitError) Error() string { return e.err.Error() }
+func (e *relayLimitError) Unwrap() error { return e.err }
+
+// mailParams returns the MAIL FROM parameters to send, given what the peer
+// advertised in its EHLO response. It returns a *relayLimitError if the
+// delivery cannot proceed because of a limit specific to this smarthost
+// (e.g. the message is too big, or REQUIRETLS can't be satisfied).
+func mailParams(opts DeliverOptions, caps map[string]string, onTLS bool) ([]string, error) {
+	var params []string
+
+	if limit, ok := caps["SIZE"]; ok && limit != "" && opts.Size > 0 {
+		var max int64
+		if _, err := fmt.Sscanf(limit, "%d", &max); err == nil && max > 0 && opts.Size > max {
+			return nil, &relayLimitError{fmt.Errorf("message size %d exceeds peer's advertised limit %d", opts.Size, max)}
+		}
+	}
+	if opts.Size > 0 {
+		if _, ok := caps["SIZE"]; ok {
+			params = append(params, fmt.Sprintf("SIZE=%d", opts.Size))
+		}
+	}
+
+	if opts.EightBitMIME {
+		if _, ok := caps["8BITMIME"]; ok {
+			params = append(params, "BODY=8BITMIME")
+		}
+	}
+
+	if opts.SMTPUTF8 {
+		if _, ok := caps["SMTPUTF8"]; ok {
+			params = append(params, "SMTPUTF8")
+		}
+	}
+
+	if opts.RequireTLS {
+		_, hasRequireTLS := caps["REQUIRETLS"]
+		if !onTLS || !hasRequireTLS {
+			return nil, &relayLimitError{fmt.Errorf("REQUIRETLS requested but peer does not support it")}
+		}
+		params = append(params, "REQUIRETLS")
+	}
+
+	return params, nil
+}
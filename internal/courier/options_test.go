@@ -0,0 +1,181 @@
+package courier
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMailParams(t *testing.T) {
+	allCaps := map[string]string{
+		"SIZE":       "1000",
+		"8BITMIME":   "",
+		"SMTPUTF8":   "",
+		"REQUIRETLS": "",
+	}
+
+	cases := []struct {
+		name   string
+		opts   DeliverOptions
+		caps   map[string]string
+		onTLS  bool
+		want   []string
+		errstr string
+	}{
+		{
+			name: "nothing requested",
+			opts: DeliverOptions{},
+			caps: allCaps,
+			want: nil,
+		},
+		{
+			name:  "size within limit",
+			opts:  DeliverOptions{Size: 500},
+			caps:  allCaps,
+			want:  []string{"SIZE=500"},
+			onTLS: true,
+		},
+		{
+			name:   "size exceeds limit",
+			opts:   DeliverOptions{Size: 5000},
+			caps:   allCaps,
+			errstr: "exceeds peer's advertised limit",
+		},
+		{
+			name: "8bitmime not advertised",
+			opts: DeliverOptions{EightBitMIME: true},
+			caps: map[string]string{},
+			want: nil,
+		},
+		{
+			name: "8bitmime advertised",
+			opts: DeliverOptions{EightBitMIME: true},
+			caps: allCaps,
+			want: []string{"BODY=8BITMIME"},
+		},
+		{
+			name: "smtputf8 advertised",
+			opts: DeliverOptions{SMTPUTF8: true},
+			caps: allCaps,
+			want: []string{"SMTPUTF8"},
+		},
+		{
+			name:  "requiretls satisfied",
+			opts:  DeliverOptions{RequireTLS: true},
+			caps:  allCaps,
+			onTLS: true,
+			want:  []string{"REQUIRETLS"},
+		},
+		{
+			name:   "requiretls not advertised",
+			opts:   DeliverOptions{RequireTLS: true},
+			caps:   map[string]string{},
+			onTLS:  true,
+			errstr: "does not support it",
+		},
+		{
+			name:   "requiretls without tls",
+			opts:   DeliverOptions{RequireTLS: true},
+			caps:   allCaps,
+			onTLS:  false,
+			errstr: "does not support it",
+		},
+	}
+
+	for _, c := range cases {
+		got, err := mailParams(c.opts, c.caps, c.onTLS)
+		if c.errstr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.errstr) {
+				t.Errorf("%s: expected error containing %q, got %v", c.name, c.errstr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSmartHostDeliverWithOptions(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250-STARTTLS\n250-SIZE 1000\n250-8BITMIME\n250-SMTPUTF8\n250 REQUIRETLS\n",
+		"STARTTLS":   "220 tls ok\n",
+
+		"MAIL FROM:<me@me> SIZE=4 BODY=8BITMIME SMTPUTF8 REQUIRETLS": "250 mail ok\n",
+		"RCPT TO:<to@to>": "250 rcpt ok\n",
+		"DATA":            "354 send data\n",
+		"_DATA":           "250 data ok\n",
+		"QUIT":            "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.rootCAs = srv.rootCAs
+	opts := DeliverOptions{
+		Size:         4,
+		EightBitMIME: true,
+		SMTPUTF8:     true,
+		RequireTLS:   true,
+	}
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), opts)
+	if err != nil {
+		t.Errorf("deliver failed: %v", err)
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSmartHostDeliverSizeExceeded(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250-STARTTLS\n250 SIZE 1\n",
+		"STARTTLS":   "220 tls ok\n",
+		"QUIT":       "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.rootCAs = srv.rootCAs
+	err, permanent := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{Size: 1000})
+	if err == nil || !strings.Contains(err.Error(), "exceeds peer's advertised limit") {
+		t.Errorf("expected size-exceeded error, got %v", err)
+	}
+	if !permanent {
+		t.Errorf("expected a permanent failure: a standalone SmartHost has no other host to retry against")
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSmartHostRequireTLSUnsupported(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250 STARTTLS\n",
+		"STARTTLS":   "220 tls ok\n",
+		"QUIT":       "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.rootCAs = srv.rootCAs
+	err, permanent := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{RequireTLS: true})
+	if err == nil || !strings.Contains(err.Error(), "does not support it") {
+		t.Errorf("expected REQUIRETLS error, got %v", err)
+	}
+	if !permanent {
+		t.Errorf("expected a permanent failure: a standalone SmartHost has no other host to retry against")
+	}
+
+	srv.wg.Wait()
+}
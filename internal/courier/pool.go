@@ -0,0 +1,219 @@
+package courier
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+)
+
+// Exported variables, per smarthost.
+var (
+	poolAttempts = expvarom.NewMap("chasquid/smarthostOut/pool_attempts",
+		"host", "count of delivery attempts, per smarthost")
+	poolSuccess = expvarom.NewMap("chasquid/smarthostOut/pool_success",
+		"host", "count of successful deliveries, per smarthost")
+	poolErrors = expvarom.NewMap("chasquid/smarthostOut/pool_errors",
+		"host", "count of delivery errors, per smarthost")
+	poolStatus = expvarom.NewMap("chasquid/smarthostOut/host_status",
+		"host", "1 if the smarthost is currently considered up, 0 if it is in its cool-down window")
+)
+
+// entrySeparator splits a multi-entry smarthost config on "/" characters
+// that separate whole entries, as opposed to the "//" inside a
+// "scheme://host" URL: those are never surrounded by whitespace, while
+// the entry separator always is.
+var entrySeparator = regexp.MustCompile(`\s+/\s+`)
+
+// poolCooldown is how long we stop trying a smarthost for, after it has
+// failed too many times in a row.
+var poolCooldown = 1 * time.Minute
+
+// poolMaxConsecFailures is how many consecutive transient failures we
+// tolerate before putting a smarthost in its cool-down window.
+const poolMaxConsecFailures = 3
+
+// poolEntry tracks health state for a single smarthost in the pool.
+type poolEntry struct {
+	sh       *SmartHost
+	priority int
+	label    string
+
+	mu             sync.Mutex
+	consecFailures int
+	cooldownUntil  time.Time
+
+	// connMu guards conns, the small pool of idle connections (at most
+	// poolMaxIdleConns) kept for reuse across deliveries (see
+	// connpool.go).
+	connMu sync.Mutex
+	conns  []*pooledConn
+}
+
+func (e *poolEntry) inCooldown() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.cooldownUntil)
+}
+
+func (e *poolEntry) recordSuccess() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.consecFailures = 0
+	e.cooldownUntil = time.Time{}
+	up := new(expvar.Int)
+	up.Set(1)
+	poolStatus.Set(e.label, up)
+}
+
+func (e *poolEntry) recordFailure() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.consecFailures++
+	if e.consecFailures >= poolMaxConsecFailures {
+		e.cooldownUntil = time.Now().Add(poolCooldown)
+		poolStatus.Set(e.label, new(expvar.Int))
+	}
+}
+
+// SmartHostPool delivers via one of several smarthosts, in priority order,
+// failing over to the next one on transient errors and tracking per-host
+// health so persistently dead relays are skipped for a while.
+type SmartHostPool struct {
+	entries []*poolEntry
+}
+
+// NewSmartHostPool builds a pool from an ordered list of smarthost URLs,
+// each given a priority from its position: they're tried in the given order.
+func NewSmartHostPool(helloDomain string, urls []url.URL) *SmartHostPool {
+	groups := make([]hostGroup, len(urls))
+	for i, u := range urls {
+		groups[i] = hostGroup{priority: i, url: u}
+	}
+	return newSmartHostPoolFromGroups(helloDomain, groups)
+}
+
+// hostGroup is a (priority, url) pair, as produced by parsing the
+// MX-style smarthost configuration syntax.
+type hostGroup struct {
+	priority int
+	url      url.URL
+}
+
+func newSmartHostPoolFromGroups(helloDomain string, groups []hostGroup) *SmartHostPool {
+	entries := make([]*poolEntry, len(groups))
+	for i, g := range groups {
+		entries[i] = &poolEntry{
+			sh: &SmartHost{
+				HelloDomain: helloDomain,
+				URL:         g.url,
+			},
+			priority: g.priority,
+			label:    g.url.Host,
+		}
+	}
+	return &SmartHostPool{entries: entries}
+}
+
+// ParseSmartHostConfig parses a smarthost configuration value into a list
+// of smarthost URLs, ordered by priority, suitable for NewSmartHostPool.
+// The priorities themselves are not returned.
+//
+// It accepts either a single smarthost URL, or an MX-style priority list
+// such as "10 smtp://relay1.example / 20 smtp://relay2.example", where
+// lower priority values are tried first and entries are separated by "/".
+func ParseSmartHostConfig(s string) ([]url.URL, error) {
+	parts := entrySeparator.Split(s, -1)
+	groups := make([]hostGroup, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		priority := 0
+		fields := strings.SplitN(part, " ", 2)
+		if len(fields) == 2 {
+			if p, err := strconv.Atoi(fields[0]); err == nil {
+				priority = p
+				part = strings.TrimSpace(fields[1])
+			}
+		}
+
+		u, err := url.Parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid smarthost URL %q: %v", part, err)
+		}
+		groups = append(groups, hostGroup{priority: priority, url: *u})
+	}
+
+	sortHostGroups(groups)
+
+	urls := make([]url.URL, len(groups))
+	for i, g := range groups {
+		urls[i] = g.url
+	}
+	return urls, nil
+}
+
+func sortHostGroups(groups []hostGroup) {
+	// Stable insertion sort: the list is always small, and we want to
+	// preserve the original order among equal priorities.
+	for i := 1; i < len(groups); i++ {
+		for j := i; j > 0 && groups[j].priority < groups[j-1].priority; j-- {
+			groups[j], groups[j-1] = groups[j-1], groups[j]
+		}
+	}
+}
+
+// Deliver an email, trying each smarthost in the pool in turn until one
+// succeeds, a permanent error is hit, or all have failed transiently.
+func (p *SmartHostPool) Deliver(from string, to string, data []byte, opts DeliverOptions) (error, bool) {
+	var lastErr error
+	lastPermanent := false
+	tried := 0
+
+	for _, e := range p.entries {
+		if e.inCooldown() {
+			continue
+		}
+
+		tried++
+		poolAttempts.Add(e.label, 1)
+		err, permanent := e.deliver(from, to, data, opts)
+		if err == nil {
+			poolSuccess.Add(e.label, 1)
+			e.recordSuccess()
+			return nil, false
+		}
+
+		poolErrors.Add(e.label, 1)
+
+		var relayErr *relayLimitError
+		if permanent && !errors.As(err, &relayErr) {
+			// Permanent, per-recipient failures don't get better by
+			// trying a different host.
+			return err, true
+		}
+
+		// Either a transient failure, or a limit specific to this
+		// smarthost (e.g. unsatisfiable SIZE/REQUIRETLS): worth trying
+		// the next host for. If every host turns out to be unsatisfiable,
+		// fall through below with the last one's permanence.
+		e.recordFailure()
+		lastErr = err
+		lastPermanent = permanent
+	}
+
+	if tried == 0 {
+		return fmt.Errorf("all smarthosts in the pool are in their cool-down window"), false
+	}
+	return fmt.Errorf("all smarthosts failed, last error: %v", lastErr), lastPermanent
+}
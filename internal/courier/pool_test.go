@@ -0,0 +1,186 @@
+package courier
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSmartHostConfigSingle(t *testing.T) {
+	urls, err := ParseSmartHostConfig("smtp://relay.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(urls) != 1 || urls[0].Host != "relay.example" {
+		t.Errorf("got %v, want a single relay.example entry", urls)
+	}
+}
+
+func TestParseSmartHostConfigPriority(t *testing.T) {
+	urls, err := ParseSmartHostConfig(
+		"20 smtp://relay2.example / 10 smtp://relay1.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(urls) != 2 {
+		t.Fatalf("got %d urls, want 2", len(urls))
+	}
+	if urls[0].Host != "relay1.example" || urls[1].Host != "relay2.example" {
+		t.Errorf("got %v, want relay1 before relay2 (lower priority first)", urls)
+	}
+}
+
+func TestSmartHostPoolFailover(t *testing.T) {
+	// down is never listened on, so connecting to it fails immediately.
+	down := "localhost:1"
+
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250 STARTTLS\n",
+		"STARTTLS":          "220 tls ok\n",
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	pool := &SmartHostPool{
+		entries: []*poolEntry{
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: down}}, label: down},
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: srv.addr}, rootCAs: srv.rootCAs}, label: srv.addr},
+		},
+	}
+
+	err, permanent := pool.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if err != nil {
+		t.Errorf("expected delivery to succeed via second host, got: %v", err)
+	}
+	if permanent {
+		t.Errorf("unexpected permanent failure")
+	}
+
+	// The successful delivery leaves its connection pooled for reuse;
+	// drain it so the fake server can shut down.
+	pool.Drain()
+	srv.wg.Wait()
+}
+
+func TestSmartHostPoolPermanentStopsFailover(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250 STARTTLS\n",
+		"STARTTLS":          "220 tls ok\n",
+		"MAIL FROM:<me@me>": "501 permanent mail error\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	neverUsed := "localhost:1"
+	pool := &SmartHostPool{
+		entries: []*poolEntry{
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: srv.addr}, rootCAs: srv.rootCAs}, label: srv.addr},
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: neverUsed}}, label: neverUsed},
+		},
+	}
+
+	err, permanent := pool.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if err == nil || !strings.Contains(err.Error(), "mail error") {
+		t.Errorf("expected the permanent MAIL error to surface, got: %v", err)
+	}
+	if !permanent {
+		t.Errorf("expected a permanent failure")
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSmartHostPoolFailsOverOnSizeLimit(t *testing.T) {
+	small := newFakeServer(t, map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250 SIZE 1\n",
+		"QUIT":       "250 quit ok\n",
+	})
+	big := newFakeServer(t, map[string]string{
+		"_welcome":                    "220 welcome\n",
+		"EHLO hello":                  "250-ehlo ok\n250 SIZE 1000000\n",
+		"MAIL FROM:<me@me> SIZE=1000": "250 mail ok\n",
+		"RCPT TO:<to@to>":             "250 rcpt ok\n",
+		"DATA":                        "354 send data\n",
+		"_DATA":                       "250 data ok\n",
+		"QUIT":                        "250 quit ok\n",
+	})
+
+	pool := &SmartHostPool{
+		entries: []*poolEntry{
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: small.addr, RawQuery: "tls=opportunistic"}, rootCAs: small.rootCAs}, label: small.addr},
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: big.addr, RawQuery: "tls=opportunistic"}, rootCAs: big.rootCAs}, label: big.addr},
+		},
+	}
+
+	err, permanent := pool.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{Size: 1000})
+	if err != nil {
+		t.Errorf("expected delivery to succeed via the second host, got: %v", err)
+	}
+	if permanent {
+		t.Errorf("unexpected permanent failure")
+	}
+
+	pool.Drain()
+	small.wg.Wait()
+	big.wg.Wait()
+}
+
+func TestSmartHostPoolSizeLimitExhausted(t *testing.T) {
+	newSizeLimitedServer := func() *fakeServer {
+		return newFakeServer(t, map[string]string{
+			"_welcome":   "220 welcome\n",
+			"EHLO hello": "250-ehlo ok\n250 SIZE 1\n",
+			"QUIT":       "250 quit ok\n",
+		})
+	}
+	srv1, srv2 := newSizeLimitedServer(), newSizeLimitedServer()
+
+	pool := &SmartHostPool{
+		entries: []*poolEntry{
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: srv1.addr, RawQuery: "tls=opportunistic"}, rootCAs: srv1.rootCAs}, label: srv1.addr},
+			{sh: &SmartHost{HelloDomain: "hello", URL: url.URL{Scheme: "smtp", Host: srv2.addr, RawQuery: "tls=opportunistic"}, rootCAs: srv2.rootCAs}, label: srv2.addr},
+		},
+	}
+
+	err, permanent := pool.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{Size: 1000})
+	if err == nil {
+		t.Errorf("expected delivery to fail on both size-limited hosts")
+	}
+	if !permanent {
+		t.Errorf("expected a permanent failure once every host in the pool is unsatisfiable")
+	}
+
+	srv1.wg.Wait()
+	srv2.wg.Wait()
+}
+
+func TestPoolEntryCooldown(t *testing.T) {
+	poolCooldown = 50 * time.Millisecond
+	defer func() { poolCooldown = 1 * time.Minute }()
+
+	e := &poolEntry{label: "test"}
+	for i := 0; i < poolMaxConsecFailures; i++ {
+		e.recordFailure()
+	}
+	if !e.inCooldown() {
+		t.Errorf("expected entry to be in cool-down after %d failures", poolMaxConsecFailures)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if e.inCooldown() {
+		t.Errorf("expected cool-down to have expired")
+	}
+
+	e.recordSuccess()
+	if e.inCooldown() {
+		t.Errorf("expected no cool-down after a success")
+	}
+}
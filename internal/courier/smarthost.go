@@ -3,9 +3,11 @@ package courier
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"net"
-	netsmtp "net/smtp"
 	"net/url"
+	"strings"
 	"time"
 
 	"blitiri.com.ar/go/chasquid/internal/expvarom"
@@ -38,68 +40,172 @@ type SmartHost struct {
 	rootCAs *x509.CertPool
 }
 
+// tlsMode returns the TLSMode to use for this smarthost, as configured via
+// the "tls" URL query parameter (e.g. "?tls=dane"). Defaults to
+// TLSStrict.
+func (s *SmartHost) tlsMode() TLSMode {
+	return parseTLSMode(s.URL.Query().Get("tls"))
+}
+
 // Deliver an email. On failures, returns an error, and whether or not it is
 // permanent.
-func (s *SmartHost) Deliver(from string, to string, data []byte) (error, bool) {
+func (s *SmartHost) Deliver(from string, to string, data []byte, opts DeliverOptions) (error, bool) {
 	tr := trace.New("Courier.SmartHost", to)
 	defer tr.Finish()
 	tr.Debugf("%s  ->  %s", from, to)
 	shAttempts.Add(1)
 
+	conn, c, onTLS, err := s.connect(tr, opts.Submission)
+	if err != nil {
+		return err, false
+	}
+	defer conn.Close()
+
+	if err, permanent := s.sendOne(tr, c, onTLS, from, to, data, opts); err != nil {
+		return err, permanent
+	}
+
+	_ = c.Quit()
+	tr.Debugf("done")
+	shSuccess.Add(1)
+
+	return nil, false
+}
+
+// connect dials the smarthost, and performs EHLO, STARTTLS, AUTH and
+// XCLIENT, as needed. The returned client is ready to send envelopes via
+// sendOne.
+func (s *SmartHost) connect(tr *trace.Trace, submission *SubmissionMeta) (net.Conn, *smtp.Client, bool, error) {
 	conn, onTLS, err := s.dial()
 	if err != nil {
-		shErrors.Add("dial", 1)
-		return tr.Errorf("Could not dial %q: %v", s.URL.Host, err), false
+		var de *daneError
+		if !errors.As(err, &de) {
+			// DANE failures already bumped their own dane-* reason in
+			// tlsConfig; don't also count them here under "dial".
+			shErrors.Add("dial", 1)
+		}
+		return nil, nil, false, tr.Errorf("Could not dial %q: %v", s.URL.Host, err)
 	}
 
-	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(shTotalTimeout))
 
-	host, _, _ := net.SplitHostPort(s.URL.Host)
+	host, port, _ := net.SplitHostPort(s.URL.Host)
 
 	c, err := smtp.NewClient(conn, host)
 	if err != nil {
+		conn.Close()
 		shErrors.Add("client", 1)
-		return tr.Errorf("Error creating client: %v", err), false
+		return nil, nil, false, tr.Errorf("Error creating client: %v", err)
 	}
 
 	if err = c.Hello(s.HelloDomain); err != nil {
+		conn.Close()
 		shErrors.Add("hello", 1)
-		return tr.Errorf("Error saying hello: %v", err), false
+		return nil, nil, false, tr.Errorf("Error saying hello: %v", err)
 	}
 
 	if !onTLS {
-		if ok, _ := c.Extension("STARTTLS"); !ok {
-			shErrors.Add("starttls-support", 1)
-			return tr.Errorf("Server does not support STARTTLS"), false
-		}
+		mode := s.tlsMode()
+		hasStartTLS, _ := c.Extension("STARTTLS")
 
-		config := &tls.Config{
-			ServerName: host,
-			RootCAs:    s.rootCAs,
-		}
-		if err = c.StartTLS(config); err != nil {
-			shErrors.Add("starttls-exchange", 1)
-			return tr.Errorf("Error in STARTTLS: %v", err), false
+		if !hasStartTLS {
+			if mode != TLSOpportunistic {
+				conn.Close()
+				shErrors.Add("starttls-support", 1)
+				return nil, nil, false, tr.Errorf("Server does not support STARTTLS")
+			}
+			// Opportunistic mode: proceed over the unencrypted
+			// connection rather than failing delivery outright.
+		} else {
+			config, cerr := s.tlsConfig(host, port)
+			if cerr != nil {
+				conn.Close()
+				return nil, nil, false, tr.Errorf("%v", cerr)
+			}
+
+			if err = c.StartTLS(config); err != nil {
+				conn.Close()
+				var de *daneError
+				if !errors.As(err, &de) {
+					// Same as above: a DANE mismatch already bumped
+					// dane-mismatch in tlsConfig's VerifyPeerCertificate.
+					shErrors.Add("starttls-exchange", 1)
+				}
+				return nil, nil, false, tr.Errorf("Error in STARTTLS: %v", err)
+			}
+			onTLS = true
 		}
 	}
 
 	if s.URL.User != nil {
+		if !onTLS {
+			conn.Close()
+			shErrors.Add("auth-plaintext", 1)
+			return nil, nil, false, tr.Errorf("Refusing to send AUTH credentials over an unencrypted connection")
+		}
+
 		user := s.URL.User.Username()
 		password, _ := s.URL.User.Password()
-		auth := netsmtp.PlainAuth("", user, password, host)
+
+		_, advertised := c.Extension("AUTH")
+		mechanism := selectAuthMechanism(advertised, s.URL.Query().Get("auth"))
+		if mechanism == "" {
+			conn.Close()
+			shErrors.Add("auth-no-mechanism", 1)
+			return nil, nil, false, tr.Errorf("No common AUTH mechanism with server (advertised: %q)", advertised)
+		}
+
+		auth, err := newAuth(mechanism, user, password, host)
+		if err != nil {
+			conn.Close()
+			shErrors.Add("auth-no-mechanism", 1)
+			return nil, nil, false, tr.Errorf("%v", err)
+		}
+
 		if err = c.Auth(auth); err != nil {
-			shErrors.Add("auth", 1)
-			return tr.Errorf("AUTH error: %v", err), false
+			conn.Close()
+			shErrors.Add("auth-"+strings.ToLower(mechanism), 1)
+			return nil, nil, false, tr.Errorf("AUTH error: %v", err)
 		}
 	}
 
+	if err = s.sendXClient(tr, c, submission); err != nil {
+		conn.Close()
+		return nil, nil, false, err
+	}
+
+	return conn, c, onTLS, nil
+}
+
+// sendOne sends a single envelope (MAIL/RCPT/DATA) over an already
+// connected and authenticated client. It can be called more than once on
+// the same client, with a RSET in between, to reuse the connection.
+func (s *SmartHost) sendOne(tr *trace.Trace, c *smtp.Client, onTLS bool, from string, to string, data []byte, opts DeliverOptions) (error, bool) {
 	// smtp.Client.Mail will add the <> for us when the address is empty.
 	if from == "<>" {
 		from = ""
 	}
 
-	if err = c.MailAndRcpt(from, to); err != nil {
+	caps := map[string]string{}
+	for _, name := range []string{"SIZE", "8BITMIME", "SMTPUTF8", "REQUIRETLS"} {
+		if ok, param := c.Extension(name); ok {
+			caps[name] = param
+		}
+	}
+
+	params, err := mailParams(opts, caps, onTLS)
+	if err != nil {
+		// Unsatisfiable SIZE/REQUIRETLS requirements are permanent as far
+		// as this smarthost is concerned: retrying the same one later
+		// won't help. A SmartHostPool recognizes the underlying
+		// *relayLimitError and fails over to another smarthost instead of
+		// bouncing the message outright; a standalone SmartHost has
+		// nowhere else to try.
+		shErrors.Add("mail-params", 1)
+		return tr.Errorf("%w", err), true
+	}
+
+	if err = c.MailAndRcpt(from, to, params...); err != nil {
 		shErrors.Add("mail", 1)
 		return tr.Errorf("MAIL+RCPT %v", err), smtp.IsPermanent(err)
 	}
@@ -121,10 +227,6 @@ func (s *SmartHost) Deliver(from string, to string, data []byte) (error, bool) {
 		return tr.Errorf("DATA closing %v", err), smtp.IsPermanent(err)
 	}
 
-	_ = c.Quit()
-	tr.Debugf("done")
-	shSuccess.Add(1)
-
 	return nil, false
 }
 
@@ -133,8 +235,11 @@ func (s *SmartHost) dial() (conn net.Conn, onTLS bool, err error) {
 
 	if s.URL.Scheme == "tls" {
 		onTLS = true
-		config := &tls.Config{
-			RootCAs: s.rootCAs,
+		host, port, _ := net.SplitHostPort(s.URL.Host)
+		var config *tls.Config
+		config, err = s.tlsConfig(host, port)
+		if err != nil {
+			return nil, false, err
 		}
 		conn, err = tls.DialWithDialer(dialer, "tcp", s.URL.Host, config)
 	} else {
@@ -143,3 +248,45 @@ func (s *SmartHost) dial() (conn net.Conn, onTLS bool, err error) {
 	}
 	return
 }
+
+// tlsConfig builds the *tls.Config to use when negotiating TLS with host
+// (implicit TLS, or via STARTTLS), honouring this smarthost's configured
+// TLSMode. In TLSDANE mode, it looks up the peer's TLSA records and
+// configures verification against them instead of the web PKI, returning
+// an error if no usable records are found.
+func (s *SmartHost) tlsConfig(host, port string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: host,
+		RootCAs:    s.rootCAs,
+	}
+
+	if s.tlsMode() != TLSDANE {
+		return config, nil
+	}
+
+	tlsas, err := lookupTLSAFunc(host, port)
+	if err != nil || len(tlsas) == 0 {
+		shErrors.Add("dane-no-tlsa", 1)
+		return nil, &daneError{fmt.Errorf("DANE required but no usable TLSA records for %q: %v", host, err)}
+	}
+
+	// We validate the chain ourselves against the TLSA records, so skip
+	// Go's web-PKI verification.
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if err := verifyDANE(rawCerts, tlsas); err != nil {
+			shErrors.Add("dane-mismatch", 1)
+			return &daneError{err}
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// daneError wraps a TLS failure that tlsConfig has already attributed to
+// a DANE-specific shErrors reason (dane-no-tlsa or dane-mismatch), so
+// callers can tell not to also count it under a generic reason.
+type daneError struct{ err error }
+
+func (e *daneError) Error() string { return e.err.Error() }
+func (e *daneError) Unwrap() error { return e.err }
@@ -24,7 +24,7 @@ func TestSmartHost(t *testing.T) {
 
 	responses := map[string]string{
 		"_welcome":   "220 welcome\n",
-		"EHLO hello": "250-ehlo ok\n250 STARTTLS AUTH HELP\n",
+		"EHLO hello": "250-ehlo ok\n250-STARTTLS\n250 AUTH PLAIN\n",
 		"STARTTLS":   "220 tls ok\n",
 
 		// Auth corresponds to the user and password below.
@@ -41,7 +41,7 @@ func TestSmartHost(t *testing.T) {
 	sh := newSmartHost(t, srv.addr)
 	sh.URL.User = url.UserPassword("user", "password")
 	sh.rootCAs = srv.rootCAs
-	err, _ := sh.Deliver("me@me", "to@to", []byte("data"))
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
 	if err != nil {
 		t.Errorf("deliver failed: %v", err)
 	}
@@ -72,7 +72,7 @@ func TestSmartHostBadAuth(t *testing.T) {
 	sh := newSmartHost(t, srv.addr)
 	sh.URL.User = url.UserPassword("user", "password")
 	sh.rootCAs = srv.rootCAs
-	err, _ := sh.Deliver("me@me", "to@to", []byte("data"))
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
 	if !strings.HasPrefix(err.Error(), "AUTH error: 454 auth error") {
 		t.Errorf("expected error in AUTH, got %q", err)
 	}
@@ -95,7 +95,7 @@ func TestSmartHostBadCert(t *testing.T) {
 	sh := newSmartHost(t, srv.addr)
 	// We do NOT set the root CA to our test server's certificate, so we
 	// expect the STARTTLS negotiation to fail.
-	err, _ := sh.Deliver("me@me", "to@to", []byte("data"))
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
 	if !strings.HasPrefix(err.Error(), "Error in STARTTLS:") {
 		t.Errorf("expected error in STARTTLS, got %q", err)
 	}
@@ -118,15 +118,6 @@ func TestSmartHostErrors(t *testing.T) {
 			"",
 		},
 
-		// No STARTTLS support.
-		{
-			makeResp(
-				"_welcome", "220 rcpt to not allowed\n",
-				"EHLO hello", "250-ehlo ok\n250 HELP\n",
-			),
-			"Server does not support STARTTLS",
-		},
-
 		// MAIL FROM not allowed.
 		{
 			makeResp(
@@ -183,7 +174,7 @@ func TestSmartHostErrors(t *testing.T) {
 		sh := newSmartHost(t, srv.addr)
 		sh.rootCAs = srv.rootCAs
 
-		err, _ := sh.Deliver("me@me", "to@to", []byte("data"))
+		err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
 		if err == nil {
 			t.Errorf("deliver not failed in case %q: %v",
 				c.responses["_welcome"], err)
@@ -200,9 +191,72 @@ func TestSmartHostErrors(t *testing.T) {
 	}
 }
 
+func TestSmartHostOpportunisticNoStartTLS(t *testing.T) {
+	// Opportunistic mode doesn't require STARTTLS support: delivery should
+	// proceed over the unencrypted connection. It must be requested
+	// explicitly, since it's not the default.
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250 HELP\n",
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "tls=opportunistic"
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if err != nil {
+		t.Errorf("deliver failed: %v", err)
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSmartHostStrictNoStartTLS(t *testing.T) {
+	// Strict mode (the default) requires STARTTLS support, unlike
+	// Opportunistic.
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250 HELP\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if !strings.Contains(err.Error(), "Server does not support STARTTLS") {
+		t.Errorf("expected STARTTLS support error, got %q", err)
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSmartHostAuthRequiresTLS(t *testing.T) {
+	// Even in Opportunistic mode, AUTH must never be sent over a
+	// plaintext connection.
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250 AUTH PLAIN\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "tls=opportunistic"
+	sh.URL.User = url.UserPassword("user", "password")
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
+	if !strings.Contains(err.Error(), "unencrypted connection") {
+		t.Errorf("expected refusal to AUTH over plaintext, got %q", err)
+	}
+
+	srv.wg.Wait()
+}
+
 func TestSmartHostDialError(t *testing.T) {
 	sh := newSmartHost(t, "localhost:1")
-	err, permanent := sh.Deliver("me@me", "to@to", []byte("data"))
+	err, permanent := sh.Deliver("me@me", "to@to", []byte("data"), DeliverOptions{})
 	if err == nil {
 		t.Errorf("delivery worked, expected failure")
 	}
@@ -0,0 +1,87 @@
+package courier
+
+import (
+	"fmt"
+	"strings"
+
+	"blitiri.com.ar/go/chasquid/internal/smtp"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// xclientEnabled reports whether this smarthost is configured to send
+// XCLIENT, via the "xclient=1" URL query parameter. It's opt-in, since
+// sending XCLIENT to a relay that doesn't expect it can cause it to be
+// rejected as a forged command.
+func (s *SmartHost) xclientEnabled() bool {
+	return s.URL.Query().Get("xclient") == "1"
+}
+
+// xclientCmd builds the XCLIENT command for the given submission
+// metadata, following Postfix's de-facto XCLIENT syntax.
+func xclientCmd(meta *SubmissionMeta) string {
+	attrs := []string{}
+
+	if meta.ClientIP != "" {
+		attrs = append(attrs, "ADDR="+xclientEscape(meta.ClientIP))
+	}
+	if meta.HELO != "" {
+		attrs = append(attrs, "NAME="+xclientEscape(meta.HELO))
+	}
+	if meta.AuthUser != "" {
+		attrs = append(attrs, "LOGIN="+xclientEscape(meta.AuthUser))
+	}
+	if meta.Proto != "" {
+		attrs = append(attrs, "PROTO="+xclientEscape(meta.Proto))
+	}
+	if meta.HELO != "" {
+		attrs = append(attrs, "HELO="+xclientEscape(meta.HELO))
+	}
+
+	return "XCLIENT " + strings.Join(attrs, " ")
+}
+
+// sendXClient forwards submission's metadata to the peer via XCLIENT, and
+// re-negotiates capabilities under the forwarded identity, as needed by
+// both a freshly connected client and a pooled one being reused for a
+// different submission. It's a no-op if XCLIENT isn't enabled for s or
+// wasn't advertised by the peer.
+func (s *SmartHost) sendXClient(tr *trace.Trace, c *smtp.Client, submission *SubmissionMeta) error {
+	if submission == nil || !s.xclientEnabled() {
+		return nil
+	}
+	if ok, _ := c.Extension("XCLIENT"); !ok {
+		return nil
+	}
+
+	if _, _, err := c.Cmd(250, "%s", xclientCmd(submission)); err != nil {
+		shErrors.Add("xclient", 1)
+		return tr.Errorf("XCLIENT error: %v", err)
+	}
+
+	// The peer now sees us as the original client; re-negotiate
+	// capabilities under that identity. We can't use Hello here: it's
+	// only callable once per connection, and connect already called it
+	// for the initial handshake.
+	if err := c.ReEhlo(); err != nil {
+		shErrors.Add("xclient-hello", 1)
+		return tr.Errorf("Error saying hello after XCLIENT: %v", err)
+	}
+	return nil
+}
+
+// xclientEscape replaces characters the XCLIENT syntax treats specially
+// ("xtext" encoding, RFC 3461) with their "+XX" hex escape. Each escape
+// encodes a single byte, so non-ASCII runes are escaped one UTF-8 byte at
+// a time rather than as their (possibly multi-digit) code point.
+func xclientEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == '+' || c == '=' || c > '~' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package courier
+
+import (
+	"testing"
+)
+
+func TestXclientCmd(t *testing.T) {
+	meta := &SubmissionMeta{
+		ClientIP: "192.0.2.1",
+		AuthUser: "user",
+		HELO:     "client.example",
+		Proto:    "ESMTPSA",
+	}
+	got := xclientCmd(meta)
+	want := "XCLIENT ADDR=192.0.2.1 NAME=client.example LOGIN=user PROTO=ESMTPSA HELO=client.example"
+	if got != want {
+		t.Errorf("xclientCmd() = %q, want %q", got, want)
+	}
+}
+
+func TestXclientEscape(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"client.example", "client.example"},
+		{"a b", "a+20b"},
+		{"a+b=c", "a+2Bb+3Dc"},
+		// Non-ASCII runes must be escaped one UTF-8 byte at a time, not as
+		// their (possibly multi-digit) code point.
+		{"λ", "+CE+BB"},
+	}
+	for _, c := range cases {
+		if got := xclientEscape(c.in); got != c.want {
+			t.Errorf("xclientEscape(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestSmartHostXclientAdvertised(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250-ehlo ok\n250-STARTTLS\n250 XCLIENT ADDR NAME LOGIN PROTO HELO\n",
+		"STARTTLS":   "220 tls ok\n",
+
+		"XCLIENT ADDR=192.0.2.1 NAME=client.example LOGIN=user PROTO=ESMTPSA HELO=client.example": "250 ok\n",
+
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "xclient=1"
+	sh.rootCAs = srv.rootCAs
+
+	opts := DeliverOptions{
+		Submission: &SubmissionMeta{
+			ClientIP: "192.0.2.1",
+			AuthUser: "user",
+			HELO:     "client.example",
+			Proto:    "ESMTPSA",
+		},
+	}
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), opts)
+	if err != nil {
+		t.Errorf("deliver failed: %v", err)
+	}
+
+	srv.wg.Wait()
+}
+
+func TestSmartHostXclientNotAdvertised(t *testing.T) {
+	responses := map[string]string{
+		"_welcome":          "220 welcome\n",
+		"EHLO hello":        "250-ehlo ok\n250 STARTTLS\n",
+		"STARTTLS":          "220 tls ok\n",
+		"MAIL FROM:<me@me>": "250 mail ok\n",
+		"RCPT TO:<to@to>":   "250 rcpt ok\n",
+		"DATA":              "354 send data\n",
+		"_DATA":             "250 data ok\n",
+		"QUIT":              "250 quit ok\n",
+	}
+	srv := newFakeServer(t, responses)
+
+	sh := newSmartHost(t, srv.addr)
+	sh.URL.RawQuery = "xclient=1"
+	sh.rootCAs = srv.rootCAs
+
+	opts := DeliverOptions{
+		Submission: &SubmissionMeta{ClientIP: "192.0.2.1"},
+	}
+	err, _ := sh.Deliver("me@me", "to@to", []byte("data"), opts)
+	if err != nil {
+		t.Errorf("deliver failed: %v", err)
+	}
+
+	srv.wg.Wait()
+}
@@ -0,0 +1,302 @@
+// Package smtp is the SMTP client used for smarthost relaying.
+//
+// It started as a fork of the standard library's net/smtp Client, which
+// says of itself that it "is frozen and is not accepting new features".
+// This package extends it with the pieces the courier package needs
+// that the frozen original doesn't have: parameterized MAIL commands
+// (SIZE, BODY=, SMTPUTF8, REQUIRETLS), a combined MAIL+RCPT helper, a way
+// to tell permanent SMTP errors from transient ones, and the ability to
+// re-negotiate capabilities mid-connection (needed after XCLIENT, since
+// that changes the peer's view of who we are).
+package smtp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// Auth and ServerInfo are the exact types net/smtp's Auth implementations
+// (PlainAuth, CRAMMD5Auth) and the courier package's own LOGIN/SCRAM ones
+// already speak, so callers can hand them straight to Client.Auth.
+type Auth = netsmtp.Auth
+type ServerInfo = netsmtp.ServerInfo
+
+// Client represents a client connection to an SMTP server.
+type Client struct {
+	text *textproto.Conn
+	conn net.Conn
+
+	tls        bool
+	serverName string
+	ext        map[string]string
+	auth       []string
+	localName  string
+	didHello   bool
+	helloError error
+}
+
+// NewClient returns a new Client using an existing connection, and host
+// as the server name to use when authenticating.
+func NewClient(conn net.Conn, host string) (*Client, error) {
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		text.Close()
+		return nil, err
+	}
+	c := &Client{text: text, conn: conn, serverName: host, localName: "localhost"}
+	_, c.tls = conn.(*tls.Conn)
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.text.Close()
+}
+
+// hello runs the EHLO exchange exactly once, regardless of how many
+// methods trigger it.
+func (c *Client) hello() error {
+	if !c.didHello {
+		c.didHello = true
+		c.helloError = c.ehlo()
+	}
+	return c.helloError
+}
+
+// Hello sends an EHLO to the server as the given host name. Calling it is
+// only necessary to control the name used; it must be called before any
+// other method, and only once.
+func (c *Client) Hello(localName string) error {
+	if err := validateLine(localName); err != nil {
+		return err
+	}
+	if c.didHello {
+		return errors.New("smtp: Hello called after other methods")
+	}
+	c.localName = localName
+	return c.hello()
+}
+
+// ReEhlo re-sends EHLO and refreshes the advertised extensions, bypassing
+// Hello's one-shot guard. It's for callers that change the peer's view of
+// who we are mid-connection (e.g. via XCLIENT) and need capabilities
+// re-negotiated under the new identity rather than once at setup time.
+func (c *Client) ReEhlo() error {
+	return c.ehlo()
+}
+
+func (c *Client) ehlo() error {
+	_, msg, err := c.Cmd(250, "EHLO %s", c.localName)
+	if err != nil {
+		return err
+	}
+	ext := make(map[string]string)
+	extList := strings.Split(msg, "\n")
+	if len(extList) > 1 {
+		extList = extList[1:]
+		for _, line := range extList {
+			k, v, _ := strings.Cut(line, " ")
+			ext[k] = v
+		}
+	}
+	if mechs, ok := ext["AUTH"]; ok {
+		c.auth = strings.Split(mechs, " ")
+	}
+	c.ext = ext
+	return nil
+}
+
+// Cmd sends a command built from format/args and reads back its
+// response, failing if the response code doesn't match expectCode (0
+// accepts any code). It's exported so callers can issue commands, such
+// as XCLIENT, that this package has no dedicated method for.
+func (c *Client) Cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expectCode)
+}
+
+// StartTLS sends the STARTTLS command and, if it succeeds, upgrades the
+// connection and re-negotiates capabilities over it. Only servers that
+// advertise the STARTTLS extension support this.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	if _, _, err := c.Cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	c.conn = tls.Client(c.conn, config)
+	c.text = textproto.NewConn(c.conn)
+	c.tls = true
+	return c.ehlo()
+}
+
+// TLSConnectionState returns the client's TLS connection state. The
+// return values are their zero values if StartTLS did not succeed.
+func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tc.ConnectionState(), true
+}
+
+// Auth authenticates the client using the given mechanism. A failed
+// authentication closes the connection. Only servers that advertise the
+// AUTH extension support this.
+func (c *Client) Auth(a Auth) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	encoding := base64.StdEncoding
+	mech, resp, err := a.Start(&ServerInfo{Name: c.serverName, TLS: c.tls, Auth: c.auth})
+	if err != nil {
+		c.Quit()
+		return err
+	}
+	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
+	encoding.Encode(resp64, resp)
+	code, msg64, err := c.Cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			// The last message isn't base64, since it isn't a challenge.
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// Abort the AUTH.
+			c.Cmd(501, "*")
+			c.Quit()
+			break
+		}
+		if resp == nil {
+			break
+		}
+		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
+		encoding.Encode(resp64, resp)
+		code, msg64, err = c.Cmd(0, string(resp64))
+	}
+	return err
+}
+
+// Extension reports whether the server supports the named extension
+// (case-insensitive), and if so, any parameters it advertised for it.
+func (c *Client) Extension(ext string) (bool, string) {
+	if err := c.hello(); err != nil {
+		return false, ""
+	}
+	if c.ext == nil {
+		return false, ""
+	}
+	ext = strings.ToUpper(ext)
+	param, ok := c.ext[ext]
+	return ok, param
+}
+
+// MailAndRcpt issues the MAIL and RCPT commands for a single envelope, in
+// one call: chasquid always sends exactly one recipient per envelope, so
+// there's no separate multi-Rcpt step to support. params (e.g.
+// "SIZE=1234", "BODY=8BITMIME", "SMTPUTF8", "REQUIRETLS") are appended to
+// the MAIL command as-is.
+func (c *Client) MailAndRcpt(from, to string, params ...string) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	if err := validateLine(to); err != nil {
+		return err
+	}
+	if err := c.hello(); err != nil {
+		return err
+	}
+
+	cmdStr := "MAIL FROM:<%s>"
+	for _, p := range params {
+		cmdStr += " " + p
+	}
+	if _, _, err := c.Cmd(250, cmdStr, from); err != nil {
+		return err
+	}
+
+	_, _, err := c.Cmd(25, "RCPT TO:<%s>", to)
+	return err
+}
+
+type dataCloser struct {
+	c *Client
+	io.WriteCloser
+}
+
+func (d *dataCloser) Close() error {
+	d.WriteCloser.Close()
+	_, _, err := d.c.text.ReadResponse(250)
+	return err
+}
+
+// Data issues a DATA command and returns a writer for the mail headers
+// and body. The caller must close the writer before calling any other
+// method on c. It must be preceded by a call to MailAndRcpt.
+func (c *Client) Data() (io.WriteCloser, error) {
+	if _, _, err := c.Cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	return &dataCloser{c, c.text.DotWriter()}, nil
+}
+
+// Reset sends RSET, aborting the current mail transaction so the
+// connection can be reused for another one.
+func (c *Client) Reset() error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	_, _, err := c.Cmd(250, "RSET")
+	return err
+}
+
+// Quit sends QUIT and closes the connection.
+func (c *Client) Quit() error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	if _, _, err := c.Cmd(221, "QUIT"); err != nil {
+		return err
+	}
+	return c.text.Close()
+}
+
+// IsPermanent reports whether err represents a permanent (5xx) SMTP
+// error, as opposed to a transient (4xx) one or a non-protocol error.
+func IsPermanent(err error) bool {
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return terr.Code >= 500
+	}
+	return false
+}
+
+// validateLine checks that a line has no CR or LF, as per RFC 5321.
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\n\r") {
+		return errors.New("smtp: a line must not contain CR or LF")
+	}
+	return nil
+}